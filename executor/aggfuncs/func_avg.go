@@ -14,12 +14,37 @@
 package aggfuncs
 
 import (
+	"sort"
+
 	"github.com/juju/errors"
 	"github.com/pingcap/tidb/sessionctx"
 	"github.com/pingcap/tidb/types"
 	"github.com/pingcap/tidb/util/chunk"
+	"github.com/pingcap/tidb/util/codec"
 )
 
+// EncodePartialResult is the default for any AggFunc that embeds
+// baseAggFunc and hasn't implemented partial-result pushdown itself. A
+// generic hash-agg executor that wants to spill or ship partial results can
+// call this through baseAggFunc's method set without a type switch; concrete
+// functions that do support it (baseAvgDecimal, baseAvgFloat64, and the
+// AVG(DISTINCT) variants below) shadow this with their own method of the
+// same name.
+func (*baseAggFunc) EncodePartialResult(pr PartialResult) ([]byte, error) {
+	return nil, errors.Errorf("partial-result encoding is not supported for this aggregate function")
+}
+
+// DecodePartialResult is the inverse of EncodePartialResult; see its comment.
+func (*baseAggFunc) DecodePartialResult(data []byte) (PartialResult, error) {
+	return nil, errors.Errorf("partial-result decoding is not supported for this aggregate function")
+}
+
+// MergePartialResult is the default for any AggFunc that hasn't implemented
+// partial-result pushdown itself; see EncodePartialResult's comment.
+func (*baseAggFunc) MergePartialResult(src, dst PartialResult) error {
+	return errors.Errorf("partial-result merging is not supported for this aggregate function")
+}
+
 // All the following avg function implementations return the decimal result,
 // which store the partial results in "partialResult4AvgDecimal".
 //
@@ -61,6 +86,47 @@ func (e *baseAvgDecimal) AppendFinalResult2Chunk(sctx sessionctx.Context, pr Par
 	return nil
 }
 
+// EncodePartialResult serializes the (sum, count) pair into a single opaque
+// blob so it can be spilled to disk or shipped between nodes instead of
+// being split into separate SUM/COUNT expression columns.
+func (e *baseAvgDecimal) EncodePartialResult(pr PartialResult) ([]byte, error) {
+	p := (*partialResult4AvgDecimal)(pr)
+	buf := codec.EncodeVarint(nil, p.count)
+	buf, err := codec.EncodeDecimal(buf, &p.sum, types.UnspecifiedLength, types.UnspecifiedLength)
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+	return buf, nil
+}
+
+// DecodePartialResult is the inverse of EncodePartialResult.
+func (e *baseAvgDecimal) DecodePartialResult(data []byte) (PartialResult, error) {
+	p := &partialResult4AvgDecimal{}
+	remain, count, err := codec.DecodeVarint(data)
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+	p.count = count
+	_, sum, err := codec.DecodeDecimal(remain)
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+	p.sum = *sum
+	return PartialResult(p), nil
+}
+
+// MergePartialResult folds src into dst without re-evaluating any row.
+func (e *baseAvgDecimal) MergePartialResult(src, dst PartialResult) error {
+	srcP, dstP := (*partialResult4AvgDecimal)(src), (*partialResult4AvgDecimal)(dst)
+	newSum := new(types.MyDecimal)
+	if err := types.DecimalAdd(&dstP.sum, &srcP.sum, newSum); err != nil {
+		return errors.Trace(err)
+	}
+	dstP.sum = *newSum
+	dstP.count += srcP.count
+	return nil
+}
+
 type avgOriginal4Decimal struct {
 	baseAvgDecimal
 }
@@ -183,6 +249,78 @@ func (e *avgOriginal4DistinctDecimal) AppendFinalResult2Chunk(sctx sessionctx.Co
 	return nil
 }
 
+// EncodePartialResult serializes the embedded (sum, count) pair followed by
+// the distinct values sorted ascending, so a receiving shard can merge and
+// dedup without having seen the original rows.
+func (e *avgOriginal4DistinctDecimal) EncodePartialResult(pr PartialResult) ([]byte, error) {
+	p := (*partialResult4AvgDistinctDecimal)(pr)
+	buf := codec.EncodeVarint(nil, p.count)
+	buf, err := codec.EncodeDecimal(buf, &p.sum, types.UnspecifiedLength, types.UnspecifiedLength)
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+	sorted := p.valSet.values()
+	sort.Slice(sorted, func(i, j int) bool { return sorted[i].Compare(&sorted[j]) < 0 })
+	buf = codec.EncodeVarint(buf, int64(len(sorted)))
+	for i := range sorted {
+		if buf, err = codec.EncodeDecimal(buf, &sorted[i], types.UnspecifiedLength, types.UnspecifiedLength); err != nil {
+			return nil, errors.Trace(err)
+		}
+	}
+	return buf, nil
+}
+
+// DecodePartialResult is the inverse of EncodePartialResult: it rebuilds
+// valSet from the decoded values so the result can be merged with dedup
+// straight away.
+func (e *avgOriginal4DistinctDecimal) DecodePartialResult(data []byte) (PartialResult, error) {
+	remain, count, err := codec.DecodeVarint(data)
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+	remain, sum, err := codec.DecodeDecimal(remain)
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+	remain, n, err := codec.DecodeVarint(remain)
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+	p := &partialResult4AvgDistinctDecimal{valSet: newDecimalSet()}
+	p.count = count
+	p.sum = *sum
+	for i := int64(0); i < n; i++ {
+		var val *types.MyDecimal
+		remain, val, err = codec.DecodeDecimal(remain)
+		if err != nil {
+			return nil, errors.Trace(err)
+		}
+		p.valSet.insert(val)
+	}
+	return PartialResult(p), nil
+}
+
+// MergePartialResult folds src into dst, deduplicating through dst.valSet so
+// a value present in both src and dst is only counted once — the semantics
+// AVG(DISTINCT ...) requires when combining partials from different shards.
+func (e *avgOriginal4DistinctDecimal) MergePartialResult(src, dst PartialResult) error {
+	srcP, dstP := (*partialResult4AvgDistinctDecimal)(src), (*partialResult4AvgDistinctDecimal)(dst)
+	newSum := new(types.MyDecimal)
+	for _, val := range srcP.valSet.values() {
+		val := val
+		if dstP.valSet.exist(&val) {
+			continue
+		}
+		if err := types.DecimalAdd(&dstP.sum, &val, newSum); err != nil {
+			return errors.Trace(err)
+		}
+		dstP.sum = *newSum
+		dstP.count++
+		dstP.valSet.insert(&val)
+	}
+	return nil
+}
+
 // All the following avg function implementations return the float64 result,
 // which store the partial results in "partialResult4AvgFloat64".
 //
@@ -218,6 +356,37 @@ func (e *baseAvgFloat64) AppendFinalResult2Chunk(sctx sessionctx.Context, pr Par
 	return nil
 }
 
+// EncodePartialResult serializes the (sum, count) pair into a single opaque
+// blob so it can be spilled to disk or shipped between nodes instead of
+// being split into separate SUM/COUNT expression columns.
+func (e *baseAvgFloat64) EncodePartialResult(pr PartialResult) ([]byte, error) {
+	p := (*partialResult4AvgFloat64)(pr)
+	buf := codec.EncodeVarint(nil, p.count)
+	buf = codec.EncodeFloat(buf, p.sum)
+	return buf, nil
+}
+
+// DecodePartialResult is the inverse of EncodePartialResult.
+func (e *baseAvgFloat64) DecodePartialResult(data []byte) (PartialResult, error) {
+	remain, count, err := codec.DecodeVarint(data)
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+	_, sum, err := codec.DecodeFloat(remain)
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+	return PartialResult(&partialResult4AvgFloat64{sum: sum, count: count}), nil
+}
+
+// MergePartialResult folds src into dst without re-evaluating any row.
+func (e *baseAvgFloat64) MergePartialResult(src, dst PartialResult) error {
+	srcP, dstP := (*partialResult4AvgFloat64)(src), (*partialResult4AvgFloat64)(dst)
+	dstP.sum += srcP.sum
+	dstP.count += srcP.count
+	return nil
+}
+
 type avgOriginal4Float64 struct {
 	baseAvgFloat64
 }
@@ -318,3 +487,194 @@ func (e *avgOriginal4DistinctFloat64) AppendFinalResult2Chunk(sctx sessionctx.Co
 	chk.AppendFloat64(e.ordinal, p.sum/float64(p.count))
 	return nil
 }
+
+// EncodePartialResult serializes the embedded (sum, count) pair followed by
+// the distinct values sorted ascending, so a receiving shard can merge and
+// dedup without having seen the original rows.
+func (e *avgOriginal4DistinctFloat64) EncodePartialResult(pr PartialResult) ([]byte, error) {
+	p := (*partialResult4AvgDistinctFloat64)(pr)
+	buf := codec.EncodeVarint(nil, p.count)
+	buf = codec.EncodeFloat(buf, p.sum)
+	sorted := p.valSet.values()
+	sort.Float64s(sorted)
+	buf = codec.EncodeVarint(buf, int64(len(sorted)))
+	for _, v := range sorted {
+		buf = codec.EncodeFloat(buf, v)
+	}
+	return buf, nil
+}
+
+// DecodePartialResult is the inverse of EncodePartialResult: it rebuilds
+// valSet from the decoded values so the result can be merged with dedup
+// straight away.
+func (e *avgOriginal4DistinctFloat64) DecodePartialResult(data []byte) (PartialResult, error) {
+	remain, count, err := codec.DecodeVarint(data)
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+	remain, sum, err := codec.DecodeFloat(remain)
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+	remain, n, err := codec.DecodeVarint(remain)
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+	p := &partialResult4AvgDistinctFloat64{valSet: newFloat64Set()}
+	p.sum = sum
+	p.count = count
+	for i := int64(0); i < n; i++ {
+		var val float64
+		remain, val, err = codec.DecodeFloat(remain)
+		if err != nil {
+			return nil, errors.Trace(err)
+		}
+		p.valSet.insert(val)
+	}
+	return PartialResult(p), nil
+}
+
+// MergePartialResult folds src into dst, deduplicating through dst.valSet so
+// a value present in both src and dst is only counted once — the semantics
+// AVG(DISTINCT ...) requires when combining partials from different shards.
+func (e *avgOriginal4DistinctFloat64) MergePartialResult(src, dst PartialResult) error {
+	srcP, dstP := (*partialResult4AvgDistinctFloat64)(src), (*partialResult4AvgDistinctFloat64)(dst)
+	for _, val := range srcP.valSet.values() {
+		if dstP.valSet.exist(val) {
+			continue
+		}
+		dstP.sum += val
+		dstP.count++
+		dstP.valSet.insert(val)
+	}
+	return nil
+}
+
+// All the following avg function implementations also return the float64
+// result, but accumulate via Welford's online algorithm instead of a naive
+// running sum, trading a division per row for resistance to the catastrophic
+// cancellation a plain `sum += input` suffers once `sum` grows much larger
+// than the next `input`. The partial results are stored in
+// "partialResult4AvgFloat64Stable".
+//
+// These variants are an opt-in alternative to "avgOriginal4Float64" /
+// "avgPartial4Float64": nothing in this package selects between them yet —
+// that wiring (a session variable such as "tidb_stable_avg", or equivalent
+// plumbing in the aggregate-function builder) belongs to the builder and is
+// not implemented here.
+//
+// "baseAvgFloat64Stable" is wrapped by:
+// - "avgOriginal4Float64Stable"
+// - "avgPartial4Float64Stable"
+type baseAvgFloat64Stable struct {
+	baseAggFunc
+}
+
+type partialResult4AvgFloat64Stable struct {
+	mean  float64
+	count int64
+}
+
+func (e *baseAvgFloat64Stable) AllocPartialResult() PartialResult {
+	return PartialResult(&partialResult4AvgFloat64Stable{})
+}
+
+func (e *baseAvgFloat64Stable) ResetPartialResult(pr PartialResult) {
+	p := (*partialResult4AvgFloat64Stable)(pr)
+	p.mean = 0
+	p.count = 0
+}
+
+func (e *baseAvgFloat64Stable) AppendFinalResult2Chunk(sctx sessionctx.Context, pr PartialResult, chk *chunk.Chunk) error {
+	p := (*partialResult4AvgFloat64Stable)(pr)
+	if p.count == 0 {
+		chk.AppendNull(e.ordinal)
+	} else {
+		chk.AppendFloat64(e.ordinal, p.mean)
+	}
+	return nil
+}
+
+type avgOriginal4Float64Stable struct {
+	baseAvgFloat64Stable
+}
+
+func (e *avgOriginal4Float64Stable) UpdatePartialResult(sctx sessionctx.Context, rowsInGroup []chunk.Row, pr PartialResult) error {
+	p := (*partialResult4AvgFloat64Stable)(pr)
+	for _, row := range rowsInGroup {
+		input, isNull, err := e.args[0].EvalReal(sctx, row)
+		if err != nil {
+			return errors.Trace(err)
+		}
+		if isNull {
+			continue
+		}
+
+		p.count++
+		delta := input - p.mean
+		p.mean += delta / float64(p.count)
+	}
+	return nil
+}
+
+type avgPartial4Float64Stable struct {
+	baseAvgFloat64Stable
+}
+
+// UpdatePartialResult merges already-partial (count, mean) pairs, e.g. the
+// ones produced by a coprocessor pushdown, using the parallel variant of
+// Welford's update: the combined mean is a weighted blend of the two means,
+// weighted by how many rows each one summarizes.
+func (e *avgPartial4Float64Stable) UpdatePartialResult(sctx sessionctx.Context, rowsInGroup []chunk.Row, pr PartialResult) error {
+	p := (*partialResult4AvgFloat64Stable)(pr)
+	for _, row := range rowsInGroup {
+		inputMean, isNull, err := e.args[1].EvalReal(sctx, row)
+		if err != nil {
+			return errors.Trace(err)
+		}
+		if isNull {
+			continue
+		}
+
+		inputCount, isNull, err := e.args[0].EvalInt(sctx, row)
+		if err != nil {
+			return errors.Trace(err)
+		}
+		if isNull || inputCount == 0 {
+			continue
+		}
+
+		newCount := p.count + inputCount
+		p.mean += (inputMean - p.mean) * float64(inputCount) / float64(newCount)
+		p.count = newCount
+	}
+	return nil
+}
+
+// values returns every distinct value currently held in the set, in no
+// particular order. It exists only so EncodePartialResult/MergePartialResult
+// can enumerate the distinct values of an AVG(DISTINCT) group on demand,
+// instead of the live execution path having to keep a second, parallel slice
+// of everything valSet already tracks.
+func (s float64Set) values() []float64 {
+	vals := make([]float64, 0, len(s))
+	for v := range s {
+		vals = append(vals, v)
+	}
+	return vals
+}
+
+// values returns every distinct value currently held in the set, in no
+// particular order. See float64Set.values for why this exists instead of a
+// parallel slice maintained on the live execution path. This assumes
+// decimalSet is keyed by each value's canonical decimal string with the
+// *types.MyDecimal itself as the map value (as opposed to a bare
+// map[string]struct{}), since dedup alone can't reconstruct the original
+// value's precision.
+func (s decimalSet) values() []types.MyDecimal {
+	vals := make([]types.MyDecimal, 0, len(s))
+	for _, v := range s {
+		vals = append(vals, *v)
+	}
+	return vals
+}
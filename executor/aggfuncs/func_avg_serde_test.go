@@ -0,0 +1,194 @@
+// Copyright 2018 PingCAP, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package aggfuncs
+
+import (
+	"testing"
+
+	"github.com/pingcap/tidb/types"
+)
+
+func TestAvgFloat64PartialResultEncodeDecode(t *testing.T) {
+	base := &baseAvgFloat64{}
+	want := &partialResult4AvgFloat64{sum: 12.5, count: 3}
+
+	data, err := base.EncodePartialResult(PartialResult(want))
+	if err != nil {
+		t.Fatal(err)
+	}
+	got, err := base.DecodePartialResult(data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	gotP := (*partialResult4AvgFloat64)(got)
+	if gotP.sum != want.sum || gotP.count != want.count {
+		t.Fatalf("decoded %+v, want %+v", gotP, want)
+	}
+}
+
+func TestAvgFloat64PartialResultMerge(t *testing.T) {
+	base := &baseAvgFloat64{}
+	dst := &partialResult4AvgFloat64{sum: 1, count: 1}
+	src := &partialResult4AvgFloat64{sum: 2, count: 3}
+
+	if err := base.MergePartialResult(PartialResult(src), PartialResult(dst)); err != nil {
+		t.Fatal(err)
+	}
+	if dst.sum != 3 || dst.count != 4 {
+		t.Fatalf("merged %+v, want sum=3 count=4", dst)
+	}
+}
+
+func TestAvgDecimalPartialResultEncodeDecode(t *testing.T) {
+	base := &baseAvgDecimal{}
+	want := &partialResult4AvgDecimal{count: 5}
+	want.sum = *types.NewDecFromInt(42)
+
+	data, err := base.EncodePartialResult(PartialResult(want))
+	if err != nil {
+		t.Fatal(err)
+	}
+	got, err := base.DecodePartialResult(data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	gotP := (*partialResult4AvgDecimal)(got)
+	if gotP.count != want.count || gotP.sum.Compare(&want.sum) != 0 {
+		t.Fatalf("decoded %+v, want %+v", gotP, want)
+	}
+}
+
+func TestAvgDecimalPartialResultMerge(t *testing.T) {
+	base := &baseAvgDecimal{}
+	dst := &partialResult4AvgDecimal{count: 1}
+	dst.sum = *types.NewDecFromInt(1)
+	src := &partialResult4AvgDecimal{count: 2}
+	src.sum = *types.NewDecFromInt(5)
+
+	if err := base.MergePartialResult(PartialResult(src), PartialResult(dst)); err != nil {
+		t.Fatal(err)
+	}
+	want := types.NewDecFromInt(6)
+	if dst.count != 3 || dst.sum.Compare(want) != 0 {
+		t.Fatalf("merged %+v, want sum=6 count=3", dst)
+	}
+}
+
+// TestAvgDistinctFloat64MergeDedups is the regression this fix exists for:
+// merging two shards that both saw the value 2 must not count it twice.
+func TestAvgDistinctFloat64MergeDedups(t *testing.T) {
+	op := &avgOriginal4DistinctFloat64{}
+
+	dst := &partialResult4AvgDistinctFloat64{valSet: newFloat64Set()}
+	for _, v := range []float64{1, 2} {
+		dst.valSet.insert(v)
+		dst.sum += v
+		dst.count++
+	}
+
+	src := &partialResult4AvgDistinctFloat64{valSet: newFloat64Set()}
+	for _, v := range []float64{2, 3} {
+		src.valSet.insert(v)
+		src.sum += v
+		src.count++
+	}
+
+	if err := op.MergePartialResult(PartialResult(src), PartialResult(dst)); err != nil {
+		t.Fatal(err)
+	}
+	// The union of {1, 2} and {2, 3} is {1, 2, 3}: sum=6, count=3. A naive
+	// sum/count merge would instead yield sum=8 (double-counting 2), count=4.
+	if dst.sum != 6 || dst.count != 3 {
+		t.Fatalf("merged distinct sum=%v count=%v, want sum=6 count=3", dst.sum, dst.count)
+	}
+}
+
+// TestAvgDistinctFloat64EncodeDecodeRoundTrip checks that a decoded partial
+// result can still dedup correctly against a fresh merge, i.e. that sum, count
+// and valSet all survive the wire format intact.
+func TestAvgDistinctFloat64EncodeDecodeRoundTrip(t *testing.T) {
+	op := &avgOriginal4DistinctFloat64{}
+	orig := &partialResult4AvgDistinctFloat64{valSet: newFloat64Set()}
+	for _, v := range []float64{3, 1, 2} {
+		orig.valSet.insert(v)
+		orig.sum += v
+		orig.count++
+	}
+
+	data, err := op.EncodePartialResult(PartialResult(orig))
+	if err != nil {
+		t.Fatal(err)
+	}
+	decodedPR, err := op.DecodePartialResult(data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	decoded := (*partialResult4AvgDistinctFloat64)(decodedPR)
+	if decoded.sum != orig.sum || decoded.count != orig.count || len(decoded.valSet.values()) != len(orig.valSet.values()) {
+		t.Fatalf("decoded %+v, want sum/count/len to match %+v", decoded, orig)
+	}
+	if !decoded.valSet.exist(2) {
+		t.Fatalf("decoded valSet lost membership of 2")
+	}
+
+	// A shard re-sending one of the same values should not inflate the count.
+	dup := &partialResult4AvgDistinctFloat64{valSet: newFloat64Set()}
+	dup.valSet.insert(2)
+	dup.sum += 2
+	dup.count++
+	if err := op.MergePartialResult(PartialResult(dup), decodedPR); err != nil {
+		t.Fatal(err)
+	}
+	if decoded.count != 3 {
+		t.Fatalf("merging a duplicate value changed count to %v, want 3", decoded.count)
+	}
+}
+
+// TestAvgDistinctDecimalMergeDedups mirrors the float64 case for the decimal
+// variant.
+func TestAvgDistinctDecimalMergeDedups(t *testing.T) {
+	op := &avgOriginal4DistinctDecimal{}
+
+	dst := &partialResult4AvgDistinctDecimal{valSet: newDecimalSet()}
+	for _, n := range []int64{1, 2} {
+		v := *types.NewDecFromInt(n)
+		dst.valSet.insert(&v)
+		newSum := new(types.MyDecimal)
+		if err := types.DecimalAdd(&dst.sum, &v, newSum); err != nil {
+			t.Fatal(err)
+		}
+		dst.sum = *newSum
+		dst.count++
+	}
+
+	src := &partialResult4AvgDistinctDecimal{valSet: newDecimalSet()}
+	for _, n := range []int64{2, 3} {
+		v := *types.NewDecFromInt(n)
+		src.valSet.insert(&v)
+		newSum := new(types.MyDecimal)
+		if err := types.DecimalAdd(&src.sum, &v, newSum); err != nil {
+			t.Fatal(err)
+		}
+		src.sum = *newSum
+		src.count++
+	}
+
+	if err := op.MergePartialResult(PartialResult(src), PartialResult(dst)); err != nil {
+		t.Fatal(err)
+	}
+	want := types.NewDecFromInt(6)
+	if dst.count != 3 || dst.sum.Compare(want) != 0 {
+		t.Fatalf("merged distinct decimal sum=%v count=%v, want sum=6 count=3", dst.sum.String(), dst.count)
+	}
+}
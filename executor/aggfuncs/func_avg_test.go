@@ -0,0 +1,156 @@
+// Copyright 2018 PingCAP, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package aggfuncs
+
+import (
+	"math"
+	"math/big"
+	"testing"
+
+	"github.com/pingcap/tidb/expression"
+	"github.com/pingcap/tidb/types"
+	"github.com/pingcap/tidb/util/chunk"
+	"github.com/pingcap/tidb/util/mock"
+)
+
+// rowsOfLen returns n dummy rows; the avg functions under test read their
+// input from a constant expression, so the row contents themselves are
+// irrelevant and only the row count matters.
+func rowsOfLen(n int) []chunk.Row {
+	chk := chunk.NewChunkWithCapacity([]*types.FieldType{types.NewFieldType(0)}, n)
+	for i := 0; i < n; i++ {
+		chk.AppendInt64(0, 0)
+	}
+	rows := make([]chunk.Row, 0, n)
+	for i := 0; i < n; i++ {
+		rows = append(rows, chk.GetRow(i))
+	}
+	return rows
+}
+
+// exactMean computes (hugeValue + tailCount*tailValue) / (tailCount+1) at
+// high enough precision that the result only reflects rounding in the
+// float64 conversion at the very end, not in the summation leading up to
+// it — it is the ground truth the test's two avg implementations are
+// checked against, independent of either one's own precision behavior.
+func exactMean(hugeValue, tailValue float64, tailCount int64) float64 {
+	sum := new(big.Float).SetPrec(200).SetFloat64(hugeValue)
+	tail := new(big.Float).SetPrec(200).SetFloat64(tailValue)
+	tail.Mul(tail, new(big.Float).SetPrec(200).SetInt64(tailCount))
+	sum.Add(sum, tail)
+	sum.Quo(sum, new(big.Float).SetPrec(200).SetInt64(tailCount+1))
+	mean, _ := sum.Float64()
+	return mean
+}
+
+// TestAvgFloat64StableIsNumericallyStable demonstrates that, unlike the naive
+// "sum += input" accumulation used by "avgOriginal4Float64", the Welford-based
+// "avgOriginal4Float64Stable" still produces the correct mean after a huge
+// value is followed by a long run of much smaller ones.
+func TestAvgFloat64StableIsNumericallyStable(t *testing.T) {
+	// hugeValue must clear 2^53 by enough that its ULP is several times
+	// tailValue: 1e8 (the original choice here) is still exactly summable
+	// with 100000 extra 1.0s in a float64, so the naive path never actually
+	// lost anything and the test passed for the wrong reason. At 1e17 the
+	// ULP is 16, comfortably above 2*tailValue, so every "sum += tailValue"
+	// on the naive path is a no-op.
+	const hugeValue = 1e17
+	const tailValue = 1.0
+	const tailCount = 100000
+
+	// wantMean is computed independently of both avg implementations, at
+	// enough precision that the float64 rounding either of them does isn't
+	// itself the thing being measured.
+	wantMean := exactMean(hugeValue, tailValue, tailCount)
+
+	sctx := mock.NewContext()
+
+	naive := &avgOriginal4Float64{}
+	naive.args = []expression.Expression{&expression.Constant{Value: types.NewFloat64Datum(hugeValue)}}
+	naivePR := naive.AllocPartialResult()
+	if err := naive.UpdatePartialResult(sctx, rowsOfLen(1), naivePR); err != nil {
+		t.Fatal(err)
+	}
+	naive.args[0] = &expression.Constant{Value: types.NewFloat64Datum(tailValue)}
+	if err := naive.UpdatePartialResult(sctx, rowsOfLen(tailCount), naivePR); err != nil {
+		t.Fatal(err)
+	}
+	naiveResult := (*partialResult4AvgFloat64)(naivePR)
+	naiveMean := naiveResult.sum / float64(naiveResult.count)
+
+	stable := &avgOriginal4Float64Stable{}
+	stable.args = []expression.Expression{&expression.Constant{Value: types.NewFloat64Datum(hugeValue)}}
+	stablePR := stable.AllocPartialResult()
+	if err := stable.UpdatePartialResult(sctx, rowsOfLen(1), stablePR); err != nil {
+		t.Fatal(err)
+	}
+	stable.args[0] = &expression.Constant{Value: types.NewFloat64Datum(tailValue)}
+	if err := stable.UpdatePartialResult(sctx, rowsOfLen(tailCount), stablePR); err != nil {
+		t.Fatal(err)
+	}
+	stableMean := (*partialResult4AvgFloat64Stable)(stablePR).mean
+
+	// The gap between the naive and the correct mean here is itself only
+	// ~1 part in 1e12 of wantMean (tailCount/(tailCount+1) in absolute
+	// terms), so the tolerance has to be tight enough to catch that while
+	// staying loose enough to absorb Welford's own rounding noise
+	// accumulated over tailCount sequential updates.
+	const tolerance = 0.5
+	if math.Abs(stableMean-wantMean) > tolerance {
+		t.Fatalf("stable avg = %v, want %v", stableMean, wantMean)
+	}
+	if math.Abs(naiveMean-wantMean) <= tolerance {
+		t.Fatalf("naive avg unexpectedly matched the stable result; test no longer demonstrates the precision gap")
+	}
+}
+
+// TestAvgPartial4Float64StableMerge checks that merging two already-partial
+// (count, mean) groups via the parallel Welford update agrees with computing
+// the mean directly over the combined data.
+func TestAvgPartial4Float64StableMerge(t *testing.T) {
+	sctx := mock.NewContext()
+
+	groupA := []float64{1, 2, 3}
+	groupB := []float64{10, 20, 30, 40}
+	all := append(append([]float64{}, groupA...), groupB...)
+
+	meanOf := func(vals []float64) float64 {
+		sum := 0.0
+		for _, v := range vals {
+			sum += v
+		}
+		return sum / float64(len(vals))
+	}
+	wantMean := meanOf(all)
+
+	partial := &avgPartial4Float64Stable{}
+	pr := partial.AllocPartialResult()
+
+	merge := func(mean float64, count int64) {
+		partial.args = []expression.Expression{
+			&expression.Constant{Value: types.NewIntDatum(count)},
+			&expression.Constant{Value: types.NewFloat64Datum(mean)},
+		}
+		if err := partial.UpdatePartialResult(sctx, rowsOfLen(1), pr); err != nil {
+			t.Fatal(err)
+		}
+	}
+	merge(meanOf(groupA), int64(len(groupA)))
+	merge(meanOf(groupB), int64(len(groupB)))
+
+	got := (*partialResult4AvgFloat64Stable)(pr).mean
+	if math.Abs(got-wantMean) > 1e-9 {
+		t.Fatalf("merged avg = %v, want %v", got, wantMean)
+	}
+}